@@ -0,0 +1,16 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff computes the sleep duration before retry attempt (0-based) using an
+// exponential schedule with full jitter: sleep = rand[0, min(max, base*2^attempt))
+func backoff(attempt int, base, max time.Duration) time.Duration {
+	upper := base << uint(attempt)
+	if upper <= 0 || upper > max {
+		upper = max
+	}
+	return time.Duration(rand.Int63n(int64(upper)))
+}
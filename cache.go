@@ -0,0 +1,174 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// cacheShardCount controls how many independent shards the response cache is split
+// into; splitting reduces lock contention under concurrent bulk lookups.
+const cacheShardCount = 16
+
+// cacheEntry is a single cached Solr response together with its expiry and its
+// position in the shard's LRU list.
+type cacheEntry struct {
+	value     string
+	expiresAt time.Time
+	elem      *list.Element
+}
+
+// cacheShard is one lock-protected slice of the overall cache.
+type cacheShard struct {
+	mu    sync.Mutex
+	items map[string]*cacheEntry
+	lru   *list.List
+}
+
+// responseCache is a sharded, TTL-based cache of raw Solr responses keyed by the
+// effective Solr URL string, with singleflight collapsing concurrent misses for the
+// same key into a single upstream call.
+type responseCache struct {
+	ttl      time.Duration
+	capacity int // per-shard capacity
+	shards   [cacheShardCount]*cacheShard
+	group    singleflight.Group
+
+	hits   uint64
+	misses uint64
+	mu     sync.Mutex // guards hits/misses
+}
+
+// newResponseCache builds a cache with the given TTL and total entry capacity, split
+// evenly across shards.
+func newResponseCache(ttl time.Duration, capacity int) *responseCache {
+	c := &responseCache{ttl: ttl, capacity: capacity / cacheShardCount}
+	if c.capacity < 1 {
+		c.capacity = 1
+	}
+	for i := range c.shards {
+		c.shards[i] = &cacheShard{
+			items: make(map[string]*cacheEntry),
+			lru:   list.New(),
+		}
+	}
+	return c
+}
+
+func (c *responseCache) shardFor(key string) *cacheShard {
+	var h uint32
+	for i := 0; i < len(key); i++ {
+		h = h*31 + uint32(key[i])
+	}
+	return c.shards[h%cacheShardCount]
+}
+
+func (c *responseCache) get(key string) (string, bool) {
+	shard := c.shardFor(key)
+	shard.mu.Lock()
+	entry, ok := shard.items[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		if ok {
+			delete(shard.items, key)
+			shard.lru.Remove(entry.elem)
+		}
+		shard.mu.Unlock()
+		c.mu.Lock()
+		c.misses++
+		c.mu.Unlock()
+		return "", false
+	}
+	shard.lru.MoveToFront(entry.elem)
+	shard.mu.Unlock()
+	c.mu.Lock()
+	c.hits++
+	c.mu.Unlock()
+	return entry.value, true
+}
+
+func (c *responseCache) set(key, value string) {
+	shard := c.shardFor(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if entry, ok := shard.items[key]; ok {
+		entry.value = value
+		entry.expiresAt = time.Now().Add(c.ttl)
+		shard.lru.MoveToFront(entry.elem)
+		return
+	}
+	elem := shard.lru.PushFront(key)
+	shard.items[key] = &cacheEntry{value: value, expiresAt: time.Now().Add(c.ttl), elem: elem}
+	for shard.lru.Len() > c.capacity {
+		oldest := shard.lru.Back()
+		if oldest == nil {
+			break
+		}
+		shard.lru.Remove(oldest)
+		delete(shard.items, oldest.Value.(string))
+	}
+}
+
+// flush empties every shard.
+func (c *responseCache) flush() {
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		shard.items = make(map[string]*cacheEntry)
+		shard.lru.Init()
+		shard.mu.Unlock()
+	}
+}
+
+// size returns the total number of entries currently cached.
+func (c *responseCache) size() int {
+	total := 0
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		total += len(shard.items)
+		shard.mu.Unlock()
+	}
+	return total
+}
+
+// stats returns hit/miss counters and the current size.
+func (c *responseCache) stats() (hits, misses uint64, size int) {
+	c.mu.Lock()
+	hits, misses = c.hits, c.misses
+	c.mu.Unlock()
+	return hits, misses, c.size()
+}
+
+// getCachedAPIResponse is getAPIResponse fronted by the response cache; concurrent
+// callers asking for the same URL collapse into a single upstream Solr call via
+// singleflight. The shared call runs on its own timeout detached from any single
+// caller's context, so one caller canceling or timing out doesn't fail every other
+// caller waiting on the same in-flight fetch; it still carries the leader caller's
+// request ID and requestMetrics (via withTracing) so the Solr call stays traceable.
+func getCachedAPIResponse(ctx context.Context, url string) (string, error) {
+	if cached, ok := respCache.get(url); ok {
+		return cached, nil
+	}
+
+	ch := respCache.group.DoChan(url, func() (interface{}, error) {
+		fetchCtx, cancel := context.WithTimeout(withTracing(context.Background(), ctx), requestTimeout)
+		defer cancel()
+		resp, err := getAPIResponse(fetchCtx, url)
+		if err != nil {
+			return "", err
+		}
+		respCache.set(url, resp)
+		return resp, nil
+	})
+
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return "", res.Err
+		}
+		return res.Val.(string), nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ctxKey is a private type so context keys set by this package can't collide with keys
+// set by other packages.
+type ctxKey int
+
+const (
+	requestIDKey ctxKey = iota
+	requestMetricsKey
+)
+
+// requestHeaderName is the header used to propagate/receive a request's trace ID
+const requestHeaderName = "X-Request-ID"
+
+// logger is the package-wide structured logger; its handler is chosen by the
+// -log-format flag in main().
+var logger *slog.Logger
+
+// newLogger builds a slog.Logger writing to stdout in either "text" or "json" format,
+// filtering out anything below level (one of "debug", "info", "warn", "error").
+func newLogger(format, level string) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: parseLogLevel(level)}
+	var handler slog.Handler
+	if format == "json" {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	}
+	return slog.New(handler)
+}
+
+// parseLogLevel maps a -log-level flag value to a slog.Level, defaulting to Info for
+// anything unrecognized.
+func parseLogLevel(level string) slog.Level {
+	switch level {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// requestMetrics accumulates the number of Solr calls and their cumulative QTime for a
+// single inbound request; a pointer to one is stashed in the request context. Bulk
+// lookups fan a request out over several worker goroutines that all share this same
+// instance, so the counters are updated atomically.
+type requestMetrics struct {
+	solrCalls int64
+	solrQTime int64
+}
+
+// requestIDMiddleware assigns every request a trace ID (honoring an inbound
+// X-Request-ID header if present), attaches it and a fresh requestMetrics to the
+// request context, and echoes it back on the response.
+func requestIDMiddleware(c *gin.Context) {
+	reqID := c.GetHeader(requestHeaderName)
+	if reqID == "" {
+		reqID = newRequestID()
+	}
+	c.Writer.Header().Set(requestHeaderName, reqID)
+
+	ctx := context.WithValue(c.Request.Context(), requestIDKey, reqID)
+	ctx = context.WithValue(ctx, requestMetricsKey, &requestMetrics{})
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+}
+
+// loggingMiddleware logs one structured line per request: method, path, status,
+// latency, and the number of Solr calls made downstream plus their cumulative QTime.
+func loggingMiddleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	metrics := requestMetricsFromContext(c.Request.Context())
+	logger.Info("request",
+		"request_id", requestIDFromContext(c.Request.Context()),
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"status", c.Writer.Status(),
+		"latency", time.Since(start).String(),
+		"solr_calls", atomic.LoadInt64(&metrics.solrCalls),
+		"solr_qtime_ms", atomic.LoadInt64(&metrics.solrQTime),
+	)
+}
+
+// newRequestID generates a random 16-byte hex trace ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestIDFromContext returns the trace ID for this request, or "" if none was set
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// requestMetricsFromContext returns the requestMetrics for this request, falling back
+// to a scratch instance when called outside of requestIDMiddleware (e.g. healthcheck
+// calls made without going through a full request context).
+func requestMetricsFromContext(ctx context.Context) *requestMetrics {
+	if m, ok := ctx.Value(requestMetricsKey).(*requestMetrics); ok {
+		return m
+	}
+	return &requestMetrics{}
+}
+
+// withTracing copies the request ID and requestMetrics pointer from src onto dst. It
+// exists for callers that must detach a context's cancellation from a single inbound
+// request (e.g. a singleflight-shared Solr fetch) without also severing that request's
+// tracing: the copied metrics pointer is the same one the owning request's
+// loggingMiddleware will read back when it finishes.
+func withTracing(dst, src context.Context) context.Context {
+	dst = context.WithValue(dst, requestIDKey, requestIDFromContext(src))
+	dst = context.WithValue(dst, requestMetricsKey, requestMetricsFromContext(src))
+	return dst
+}
+
+// recordSolrCall updates the cumulative Solr call count and QTime for the request that
+// owns ctx, pulling QTime out of a raw Solr JSON response body. Best-effort: a body
+// that doesn't parse as a solrFullResponse simply contributes zero QTime.
+func recordSolrCall(ctx context.Context, body string) {
+	metrics := requestMetricsFromContext(ctx)
+	atomic.AddInt64(&metrics.solrCalls, 1)
+
+	var resp solrFullResponse
+	if err := json.Unmarshal([]byte(body), &resp); err == nil {
+		atomic.AddInt64(&metrics.solrQTime, int64(resp.ResponseHeader.QTime))
+	}
+}
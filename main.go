@@ -1,14 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -22,6 +25,34 @@ var solrURL string
 var solrCore string
 var avalonURL string
 
+// workers is the size of the worker pool used to fan out bulk lookups
+var workers int
+
+// retries is the maximum number of attempts made against Solr before giving up
+var retries int
+
+// requestTimeout bounds how long a single inbound request is allowed to wait on Solr
+var requestTimeout time.Duration
+
+// cacheTTL and cacheSize configure the in-process Solr response cache
+var cacheTTL time.Duration
+var cacheSize int
+
+// respCache caches raw Solr responses to cut load from repeated harvester scans
+var respCache *responseCache
+
+const backoffBase = 100 * time.Millisecond
+const backoffMax = 5 * time.Second
+
+// httpClient is shared across all Solr requests so connections can be reused; a
+// per-call context.Context (not client.Timeout) is what bounds any individual request.
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		MaxIdleConnsPerHost: 20,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
 // aries is the structure of the response returned by /api/aries/:id
 type aries struct {
 	Identifiers    []string     `json:"identifier,omitempty"`
@@ -81,8 +112,10 @@ func healthCheckHandler(c *gin.Context) {
 	hcMap := make(map[string]string)
 	hcMap["AriesAvalon"] = "true"
 	// ping the api with a minimal request to see if it is alive
+	ctx, cancel := context.WithTimeout(c.Request.Context(), requestTimeout)
+	defer cancel()
 	url := fmt.Sprintf("%s/%s/select?q=*:*&wt=json&rows=0", solrURL, solrCore)
-	_, err := getAPIResponse(url)
+	_, err := getAPIResponse(ctx, url)
 	if err != nil {
 		hcMap["Avalon"] = "false"
 	} else {
@@ -91,58 +124,93 @@ func healthCheckHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, hcMap)
 }
 
-/// ariesPing handles requests to the aries endpoint with no params.
+// cacheStatsHandler reports hit/miss counts and the current entry count of the response cache
+func cacheStatsHandler(c *gin.Context) {
+	hits, misses, size := respCache.stats()
+	c.JSON(http.StatusOK, gin.H{"hits": hits, "misses": misses, "size": size})
+}
+
+// cacheFlushHandler empties the response cache
+func cacheFlushHandler(c *gin.Context) {
+	respCache.flush()
+	c.String(http.StatusOK, "cache flushed")
+}
+
+/// ariesPing handles requests to the aries endpoint with no params, unless a
+// GET ?ids=a,b,c is present, in which case it behaves like the bulk lookup endpoint.
 // Just returns and alive message
 func ariesPing(c *gin.Context) {
-	c.String(http.StatusOK, "Avalon Aries API")
+	if c.Query("ids") == "" {
+		c.String(http.StatusOK, "Avalon Aries API")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), requestTimeout)
+	defer cancel()
+	ids := strings.Split(c.Query("ids"), ",")
+	c.JSON(http.StatusOK, runBulkLookup(ctx, ids))
 }
 
 // ariesLookup will query APTrust for information on the supplied identifer
 func ariesLookup(c *gin.Context) {
 	passedID := c.Param("id")
+	ctx, cancel := context.WithTimeout(c.Request.Context(), requestTimeout)
+	defer cancel()
+	out, err := lookupOne(ctx, passedID)
+	if err != nil {
+		logger.Error("lookup failed", "id", passedID, "error", err.Error())
+		if errors.Is(err, errTooManyHits) {
+			c.String(http.StatusBadRequest, err.Error())
+		} else {
+			c.String(http.StatusNotFound, err.Error())
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, out)
+}
+
+// errTooManyHits is returned by lookupOne when a query matches more than one solr document
+var errTooManyHits = errors.New("too many hits")
+
+// lookupOne queries Avalon solr for the supplied identifier and assembles the aries
+// response for it. It is the shared core used by both the single-ID and bulk lookup
+// handlers.
+func lookupOne(ctx context.Context, passedID string) (aries, error) {
+	var out aries
 	qs := url.QueryEscape(fmt.Sprintf("id:\"%s\"", passedID))
 	fl := "&fl=id,identifier_ssim,file_location_ssi,has_model_ssim,isPartOf_ssim"
 	urlStr := fmt.Sprintf("%s/%s/select?q=%s&wt=json&indent=true%s", solrURL, solrCore, qs, fl)
-	respStr, err := getAPIResponse(urlStr)
+	respStr, err := getCachedAPIResponse(ctx, urlStr)
 	if err != nil {
-		log.Printf("Query for %s FAILED: %s", passedID, err.Error())
-		c.String(http.StatusNotFound, err.Error())
-		return
+		return out, err
 	}
 
 	var resp solrFullResponse
 	marshallErr := json.Unmarshal([]byte(respStr), &resp)
 	if marshallErr != nil {
-		log.Printf("Unable to parse response: %s", marshallErr.Error())
-		c.String(http.StatusNotFound, "%s not found", passedID)
-		return
+		return out, fmt.Errorf("%s not found", passedID)
 	}
 
 	if resp.Response.NumFound == 0 {
-		log.Printf("Query for ID=%s had no hits; check in identifier_ssim", passedID)
+		logger.Debug("no hits on id, falling back to identifier_ssim", "id", passedID)
 		qs = url.QueryEscape(fmt.Sprintf("identifier_ssim:\"%s\"", passedID))
 		urlStr = fmt.Sprintf("%s/%s/select?q=%s&wt=json&indent=true%s", solrURL, solrCore, qs, fl)
-		respStr, _ = getAPIResponse(urlStr)
+		respStr, _ = getCachedAPIResponse(ctx, urlStr)
 		marshallErr := json.Unmarshal([]byte(respStr), &resp)
 		if marshallErr != nil {
-			log.Printf("Unable to parse response: %s", marshallErr.Error())
-			c.String(http.StatusNotFound, "%s not found", passedID)
-			return
+			return out, fmt.Errorf("%s not found", passedID)
 		}
 		if resp.Response.NumFound == 0 {
-			log.Printf("Query for identifier_ssim=%s had no hits", passedID)
-			c.String(http.StatusNotFound, "%s not found", passedID)
-			return
+			logger.Debug("no hits on identifier_ssim either", "id", passedID)
+			return out, fmt.Errorf("%s not found", passedID)
 		}
 	}
 
 	if resp.Response.NumFound > 1 {
-		log.Printf("Query for %s had too many hits", passedID)
-		c.String(http.StatusBadRequest, "%s has too many hits. Query: %s", passedID, urlStr)
-		return
+		return out, fmt.Errorf("%s has too many hits. Query: %s: %w", passedID, urlStr, errTooManyHits)
 	}
 
-	var out aries
 	doc := resp.Response.Docs[0]
 	out.Identifiers = append(out.Identifiers, doc.ID)
 	for _, altID := range doc.IdentifierSSIM {
@@ -157,12 +225,12 @@ func ariesLookup(c *gin.Context) {
 		Protocol: "avalon-index"}
 	out.ServiceURL = append(out.ServiceURL, svcURL)
 
-	if doc.Model[0] == "MediaObject" {
+	if len(doc.Model) > 0 && doc.Model[0] == "MediaObject" {
 		// MediaObjects have descMetadata
 		out.MetadataURL = append(out.MetadataURL, fmt.Sprintf("%s/media_objects/%s/content/descMetadata", avalonURL, doc.ID))
 		out.AccessURL = append(out.AccessURL, fmt.Sprintf("%s/media_objects/%s", avalonURL, doc.ID))
 		out.AdminURL = append(out.AdminURL, fmt.Sprintf("%s/media_objects/%s/edit", avalonURL, doc.ID))
-	} else {
+	} else if len(doc.PartOf) > 0 {
 		// Master files are have no metadata, are nested under their parent URL and can have derivatives
 		out.AccessURL = append(out.AccessURL, fmt.Sprintf("%s/media_objects/%s/section/%s", avalonURL, doc.PartOf[0], doc.ID))
 		out.AdminURL = append(out.AdminURL, fmt.Sprintf("%s/media_objects/%s/section/%s/edit", avalonURL, doc.PartOf[0], doc.ID))
@@ -170,7 +238,7 @@ func ariesLookup(c *gin.Context) {
 		qs = url.QueryEscape(fmt.Sprintf("isDerivationOf_ssim:\"%s\"", doc.ID))
 		fl = "&fl=id,derivativeFile_ssi"
 		urlStr = fmt.Sprintf("%s/%s/select?q=%s&wt=json&indent=true%s", solrURL, solrCore, qs, fl)
-		respStr, _ = getAPIResponse(urlStr)
+		respStr, _ = getCachedAPIResponse(ctx, urlStr)
 		marshallErr = json.Unmarshal([]byte(respStr), &resp)
 		if marshallErr == nil {
 			for _, d := range resp.Response.Docs {
@@ -181,7 +249,79 @@ func ariesLookup(c *gin.Context) {
 		}
 	}
 
-	c.JSON(http.StatusOK, out)
+	return out, nil
+}
+
+// bulkLookupRequest is the expected JSON body of POST /api/aries/lookup
+type bulkLookupRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// ariesBulkLookup resolves many identifiers in one request, fanning the individual
+// lookups out over a bounded worker pool so the caller doesn't have to loop over
+// the single-ID endpoint (and the service doesn't open hundreds of Solr connections
+// at once doing it).
+func ariesBulkLookup(c *gin.Context) {
+	var req bulkLookupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), requestTimeout)
+	defer cancel()
+	c.JSON(http.StatusOK, runBulkLookup(ctx, req.IDs))
+}
+
+// runBulkLookup fans the given IDs out over the worker pool and resolves each to its
+// aries response (or an error entry), keyed by the requested ID. Shared by the GET
+// ?ids= variant on /api/aries and the POST JSON-body variant on /api/aries/lookup.
+func runBulkLookup(ctx context.Context, ids []string) map[string]interface{} {
+	out := make(map[string]interface{})
+	var outMu sync.Mutex
+	var wg sync.WaitGroup
+	idCh := make(chan string)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range idCh {
+				res, err := safeLookupOne(ctx, id)
+				outMu.Lock()
+				if err != nil {
+					out[id] = gin.H{"error": err.Error()}
+				} else {
+					out[id] = res
+				}
+				outMu.Unlock()
+			}
+		}()
+	}
+
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+		idCh <- id
+	}
+	close(idCh)
+	wg.Wait()
+
+	return out
+}
+
+// safeLookupOne wraps lookupOne with a recover so that an unexpected panic inside one
+// bulk worker goroutine (where gin's Recovery middleware can't catch it) surfaces as a
+// per-ID error instead of crashing the whole process.
+func safeLookupOne(ctx context.Context, id string) (out aries, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("lookup of %s panicked: %v", id, r)
+		}
+	}()
+	return lookupOne(ctx, id)
 }
 
 func hasValue(values []string, tgtVal string) bool {
@@ -193,57 +333,111 @@ func hasValue(values []string, tgtVal string) bool {
 	return false
 }
 
-// getAPIResponse is a helper used to call a JSON endpoint and return the resoponse as a string
-func getAPIResponse(url string) (string, error) {
-	log.Printf("Get resonse for: %s", url)
-	timeout := time.Duration(10 * time.Second)
-	client := http.Client{
-		Timeout: timeout,
-	}
-	resp, err := client.Get(url)
-	if err != nil {
-		log.Printf("Unable to GET %s: %s", url, err.Error())
-		return "", err
-	}
+// getAPIResponse is a helper used to call a JSON endpoint and return the resoponse as a string.
+// Network errors and 5xx / 429 responses are retried with exponential backoff and full jitter;
+// any other non-2xx response is returned immediately as an error. The supplied context bounds
+// the whole call, including any retries, so a caller that gives up stops the in-flight request.
+func getAPIResponse(ctx context.Context, url string) (string, error) {
+	logger.Debug("get solr response", "request_id", requestIDFromContext(ctx), "url", url)
+
+	var lastErr error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			sleep := backoff(attempt-1, backoffBase, backoffMax)
+			logger.Debug("retrying solr request", "request_id", requestIDFromContext(ctx), "url", url, "attempt", attempt, "sleep", sleep.String())
+			select {
+			case <-time.After(sleep):
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return "", err
+		}
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			logger.Warn("solr request failed", "request_id", requestIDFromContext(ctx), "url", url, "error", err.Error())
+			lastErr = err
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			continue
+		}
 
-	defer resp.Body.Close()
-	bodyBytes, _ := ioutil.ReadAll(resp.Body)
-	respString := string(bodyBytes)
-	if resp.StatusCode != 200 {
-		return "", errors.New(respString)
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		respString := string(bodyBytes)
+		if resp.StatusCode == http.StatusOK {
+			recordSolrCall(ctx, respString)
+			return respString, nil
+		}
+
+		lastErr = errors.New(respString)
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < http.StatusInternalServerError {
+			// non-retryable 4xx (other than 429): return immediately
+			return "", lastErr
+		}
 	}
-	return respString, nil
+
+	return "", lastErr
 }
 
 /**
  * MAIN
  */
 func main() {
-	log.Printf("===> Aries Avalon service staring up <===")
+	logger = newLogger("text", "info")
+	logger.Info("===> Aries Avalon service staring up <===")
 
 	// Get config params
-	log.Printf("Read configuration...")
+	logger.Info("Read configuration...")
 	var port int
 	flag.IntVar(&port, "port", 8080, "Aries Avalon port (default 8080)")
 	flag.StringVar(&solrURL, "solrurl", "http://avalon.lib.virginia.edu:8983/solr", "Avalon Solr base URL")
 	flag.StringVar(&solrCore, "solrcore", "avalon", "Avalon Solr core")
 	flag.StringVar(&avalonURL, "avalonurl", "http://avalon.lib.virginia.edu", "Avalon URL")
+	flag.IntVar(&workers, "workers", 8, "Size of the worker pool used for bulk lookups")
+	flag.IntVar(&retries, "retries", 3, "Maximum number of retries for a Solr request")
+	flag.DurationVar(&requestTimeout, "timeout", 10*time.Second, "Per-request timeout for Solr queries")
+	flag.DurationVar(&cacheTTL, "cache-ttl", 5*time.Minute, "TTL for cached Solr responses")
+	flag.IntVar(&cacheSize, "cache-size", 10000, "Maximum number of entries held in the response cache")
+	var logFormat string
+	flag.StringVar(&logFormat, "log-format", "text", "Log format: text or json")
+	var logLevel string
+	flag.StringVar(&logLevel, "log-level", "info", "Log level: debug, info, warn, or error")
 	flag.Parse()
 
-	log.Printf("Setup routes...")
+	if workers < 1 {
+		workers = 1
+	}
+
+	logger = newLogger(logFormat, logLevel)
+	respCache = newResponseCache(cacheTTL, cacheSize)
+
+	logger.Info("Setup routes...")
 	gin.SetMode(gin.ReleaseMode)
 	gin.DisableConsoleColor()
 	router := gin.Default()
+	router.Use(requestIDMiddleware, loggingMiddleware)
 	router.GET("/favicon.ico", favHandler)
 	router.GET("/version", versionHandler)
 	router.GET("/healthcheck", healthCheckHandler)
+	router.GET("/cache/stats", cacheStatsHandler)
+	router.POST("/cache/flush", cacheFlushHandler)
 	api := router.Group("/api")
 	{
 		api.GET("/aries", ariesPing)
 		api.GET("/aries/:id", ariesLookup)
+		api.POST("/aries/lookup", ariesBulkLookup)
 	}
 
 	portStr := fmt.Sprintf(":%d", port)
-	log.Printf("Start Aries Avalon v%s on port %s", version, portStr)
-	log.Fatal(router.Run(portStr))
+	logger.Info("Start Aries Avalon", "version", version, "port", portStr)
+	if err := router.Run(portStr); err != nil {
+		logger.Error("server exited", "error", err.Error())
+		os.Exit(1)
+	}
 }